@@ -0,0 +1,451 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// collectSharedDefinitions finds inline schema fragments (parameter bodies, response
+// bodies, and anything nested below them) that show up more than once and hence can be
+// shared across all the operations to save space, the same way collectSharedParameters
+// does for parameters.
+func collectSharedDefinitions(sp *spec.Swagger) (namesByJSON map[string]string, ret map[string]spec.Schema, err error) {
+
+	if sp == nil || sp.Paths == nil {
+		return nil, nil, nil
+	}
+
+	countsByJSON := map[string]int{}
+	shared := map[string]spec.Schema{}
+	var keys []string
+
+	collect := func(s *spec.Schema) error {
+		bs, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		countsByJSON[string(bs)]++
+		if count := countsByJSON[string(bs)]; count == 1 {
+			shared[string(bs)] = *s
+			keys = append(keys, string(bs))
+		}
+
+		return nil
+	}
+
+	for _, path := range sp.Paths.Paths {
+		for _, op := range []*spec.Operation{path.Get, path.Put, path.Post, path.Delete, path.Options, path.Head, path.Patch} {
+			if op == nil {
+				continue // shouldn't happen, but ignore if it does
+			}
+
+			for i := range op.Parameters {
+				p := op.Parameters[i]
+				if p.Ref.String() != "" || p.Schema == nil {
+					continue
+				}
+				if err := collectSchema(p.Schema, collect); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			if op.Responses == nil {
+				continue
+			}
+
+			if op.Responses.Default != nil && op.Responses.Default.Ref.String() == "" && op.Responses.Default.Schema != nil {
+				if err := collectSchema(op.Responses.Default.Schema, collect); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			for code := range op.Responses.StatusCodeResponses {
+				r := op.Responses.StatusCodeResponses[code]
+				if r.Ref.String() != "" || r.Schema == nil {
+					continue
+				}
+				if err := collectSchema(r.Schema, collect); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	// name deterministically
+	sort.Strings(keys)
+	ret = map[string]spec.Schema{}
+	namesByJSON = map[string]string{}
+	for _, k := range keys {
+		if countsByJSON[k] <= 1 {
+			// A schema that only occurs once would come back out strictly larger than
+			// it went in: a $ref plus a dictionary entry instead of the inline schema.
+			// Leave it alone.
+			continue
+		}
+
+		name := shared[k].ID
+		if name == "" {
+			name = "schema"
+		}
+		name += "-" + base64Hash(k)
+		i := 0
+		for {
+			if _, ok := ret[name]; !ok {
+				ret[name] = shared[k]
+				namesByJSON[k] = name
+				break
+			}
+			i++ // only on hash conflict, unlikely with our few variants
+			name = "schema-" + strconv.Itoa(i)
+		}
+	}
+
+	return namesByJSON, ret, nil
+}
+
+// collectSchema calls collect on s and, recursively, on every inline (non-$ref)
+// schema reachable from it. It does not descend into schemas that are already $refs,
+// since those are either already shared or point at a top-level definition.
+func collectSchema(s *spec.Schema, collect func(*spec.Schema) error) error {
+	if s == nil || s.Ref.String() != "" {
+		return nil
+	}
+
+	if err := collect(s); err != nil {
+		return err
+	}
+
+	for name := range s.Properties {
+		c := s.Properties[name]
+		if err := collectSchema(&c, collect); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		if err := collectSchema(s.AdditionalProperties.Schema, collect); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if s.Items.Schema != nil {
+			if err := collectSchema(s.Items.Schema, collect); err != nil {
+				return err
+			}
+		}
+		for i := range s.Items.Schemas {
+			if err := collectSchema(&s.Items.Schemas[i], collect); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range s.AllOf {
+		if err := collectSchema(&s.AllOf[i], collect); err != nil {
+			return err
+		}
+	}
+	for i := range s.AnyOf {
+		if err := collectSchema(&s.AnyOf[i], collect); err != nil {
+			return err
+		}
+	}
+	for i := range s.OneOf {
+		if err := collectSchema(&s.OneOf[i], collect); err != nil {
+			return err
+		}
+	}
+	if s.Not != nil {
+		if err := collectSchema(s.Not, collect); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replaceSharedDefinitions(sharedDefinitionNamesByJSON map[string]string, sp *spec.Swagger) (*spec.Swagger, error) {
+	if sp == nil || sp.Paths == nil {
+		return sp, nil
+	}
+
+	ret := sp
+
+	firstPathChange := true
+	for k, path := range sp.Paths.Paths {
+		pathChanged := false
+
+		for _, op := range []**spec.Operation{&path.Get, &path.Put, &path.Post, &path.Delete, &path.Options, &path.Head, &path.Patch} {
+			if *op == nil {
+				continue
+			}
+
+			firstOpChange := true
+			cloneOp := func() {
+				if !firstOpChange {
+					return
+				}
+				orig := *op
+				*op = &spec.Operation{}
+				**op = *orig
+				firstOpChange = false
+			}
+
+			firstParamChange := true
+			for i := range (*op).Parameters {
+				p := (*op).Parameters[i]
+				if p.Ref.String() != "" || p.Schema == nil {
+					continue
+				}
+
+				newSchema, changed, err := replaceSchema(p.Schema, sharedDefinitionNamesByJSON)
+				if err != nil {
+					return nil, err
+				}
+				if !changed {
+					continue
+				}
+
+				cloneOp()
+				if firstParamChange {
+					orig := (*op).Parameters
+					(*op).Parameters = make([]spec.Parameter, len(orig))
+					copy((*op).Parameters, orig)
+					firstParamChange = false
+				}
+				p.Schema = newSchema
+				(*op).Parameters[i] = p
+				pathChanged = true
+			}
+
+			if (*op).Responses == nil {
+				continue
+			}
+
+			firstRespChange := true
+			cloneResponses := func() {
+				if !firstRespChange {
+					return
+				}
+				respClone := *(*op).Responses
+				(*op).Responses = &respClone
+				(*op).Responses.StatusCodeResponses = make(map[int]spec.Response, len(respClone.StatusCodeResponses))
+				for code, r := range respClone.StatusCodeResponses {
+					(*op).Responses.StatusCodeResponses[code] = r
+				}
+				firstRespChange = false
+			}
+
+			if (*op).Responses.Default != nil && (*op).Responses.Default.Ref.String() == "" && (*op).Responses.Default.Schema != nil {
+				newSchema, changed, err := replaceSchema((*op).Responses.Default.Schema, sharedDefinitionNamesByJSON)
+				if err != nil {
+					return nil, err
+				}
+				if changed {
+					cloneOp()
+					cloneResponses()
+					defClone := *(*op).Responses.Default
+					defClone.Schema = newSchema
+					(*op).Responses.Default = &defClone
+					pathChanged = true
+				}
+			}
+
+			for code := range (*op).Responses.StatusCodeResponses {
+				r := (*op).Responses.StatusCodeResponses[code]
+				if r.Ref.String() != "" || r.Schema == nil {
+					continue
+				}
+
+				newSchema, changed, err := replaceSchema(r.Schema, sharedDefinitionNamesByJSON)
+				if err != nil {
+					return nil, err
+				}
+				if !changed {
+					continue
+				}
+
+				cloneOp()
+				cloneResponses()
+				r.Schema = newSchema
+				(*op).Responses.StatusCodeResponses[code] = r
+				pathChanged = true
+			}
+		}
+
+		if pathChanged {
+			if firstPathChange {
+				clone := *sp
+				ret = &clone
+
+				pathsClone := *ret.Paths
+				ret.Paths = &pathsClone
+
+				ret.Paths.Paths = make(map[string]spec.PathItem, len(sp.Paths.Paths))
+				for k, v := range sp.Paths.Paths {
+					ret.Paths.Paths[k] = v
+				}
+
+				firstPathChange = false
+			}
+			ret.Paths.Paths[k] = path
+		}
+	}
+
+	return ret, nil
+}
+
+// replaceSchema returns a schema with any inline fragment matching
+// sharedDefinitionNamesByJSON replaced by a $ref to its shared definition. It returns
+// the original pointer and changed=false when nothing below s needed rewriting, so
+// callers can skip cloning their own containers when there's nothing to do.
+func replaceSchema(s *spec.Schema, namesByJSON map[string]string) (*spec.Schema, bool, error) {
+	if s == nil || s.Ref.String() != "" {
+		return s, false, nil
+	}
+
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if name, ok := namesByJSON[string(bs)]; ok {
+		return &spec.Schema{SchemaProps: spec.SchemaProps{Ref: spec.MustCreateRef("#/definitions/" + name)}}, true, nil
+	}
+
+	changed := false
+	clone := *s
+
+	if len(s.Properties) > 0 {
+		props := make(map[string]spec.Schema, len(s.Properties))
+		for name, child := range s.Properties {
+			c := child
+			newChild, childChanged, err := replaceSchema(&c, namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				changed = true
+				props[name] = *newChild
+			} else {
+				props[name] = child
+			}
+		}
+		clone.Properties = props
+	}
+
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		newChild, childChanged, err := replaceSchema(s.AdditionalProperties.Schema, namesByJSON)
+		if err != nil {
+			return nil, false, err
+		}
+		if childChanged {
+			changed = true
+			apClone := *s.AdditionalProperties
+			apClone.Schema = newChild
+			clone.AdditionalProperties = &apClone
+		}
+	}
+
+	if s.Items != nil {
+		itemsClone := *s.Items
+		itemsChanged := false
+
+		if s.Items.Schema != nil {
+			newChild, childChanged, err := replaceSchema(s.Items.Schema, namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				itemsChanged = true
+				itemsClone.Schema = newChild
+			}
+		}
+
+		if len(s.Items.Schemas) > 0 {
+			schemas := make([]spec.Schema, len(s.Items.Schemas))
+			copy(schemas, s.Items.Schemas)
+			for i := range schemas {
+				newChild, childChanged, err := replaceSchema(&schemas[i], namesByJSON)
+				if err != nil {
+					return nil, false, err
+				}
+				if childChanged {
+					itemsChanged = true
+					schemas[i] = *newChild
+				}
+			}
+			itemsClone.Schemas = schemas
+		}
+
+		if itemsChanged {
+			changed = true
+			clone.Items = &itemsClone
+		}
+	}
+
+	for _, list := range []struct {
+		get func() []spec.Schema
+		set func([]spec.Schema)
+	}{
+		{func() []spec.Schema { return s.AllOf }, func(v []spec.Schema) { clone.AllOf = v }},
+		{func() []spec.Schema { return s.AnyOf }, func(v []spec.Schema) { clone.AnyOf = v }},
+		{func() []spec.Schema { return s.OneOf }, func(v []spec.Schema) { clone.OneOf = v }},
+	} {
+		orig := list.get()
+		if len(orig) == 0 {
+			continue
+		}
+		out := make([]spec.Schema, len(orig))
+		copy(out, orig)
+		listChanged := false
+		for i := range out {
+			newChild, childChanged, err := replaceSchema(&out[i], namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				listChanged = true
+				out[i] = *newChild
+			}
+		}
+		if listChanged {
+			changed = true
+			list.set(out)
+		}
+	}
+
+	if s.Not != nil {
+		newChild, childChanged, err := replaceSchema(s.Not, namesByJSON)
+		if err != nil {
+			return nil, false, err
+		}
+		if childChanged {
+			changed = true
+			clone.Not = newChild
+		}
+	}
+
+	if !changed {
+		return s, false, nil
+	}
+	return &clone, true, nil
+}
@@ -17,39 +17,160 @@ limitations under the License.
 package builder
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"hash"
 	"sort"
 	"strconv"
+	"strings"
 
 	"k8s.io/kube-openapi/pkg/validation/spec"
 )
 
+// parameterDigest is the fixed-size output of hashing a parameter's canonical encoding,
+// used as a map key so collecting and replacing shared parameters across a large spec
+// doesn't have to keep the full serialized JSON of every occurrence around just to
+// compare them.
+type parameterDigest [sha256.Size224]byte
+
+// parameterCanonicalizer streams each parameter's canonical JSON encoding into a reused
+// buffer and hashes it with a reused hash.Hash, rather than allocating a fresh []byte
+// per occurrence via json.Marshal. Its zero value is not usable; construct one with
+// newParameterCanonicalizer.
+type parameterCanonicalizer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+	h   hash.Hash
+}
+
+func newParameterCanonicalizer() *parameterCanonicalizer {
+	c := &parameterCanonicalizer{h: sha256.New224()}
+	c.enc = json.NewEncoder(&c.buf)
+	return c
+}
+
+// digest returns a fixed-size hash of p's canonical encoding, along with the encoding
+// itself so callers can defeat the astronomically unlikely but possible hash collision
+// between two different parameters. The returned slice aliases the canonicalizer's
+// internal buffer and is only valid until the next call to digest; copy it if it needs
+// to outlive that call.
+func (c *parameterCanonicalizer) digest(p *spec.Parameter) (parameterDigest, []byte, error) {
+	c.buf.Reset()
+	if err := c.enc.Encode(p); err != nil {
+		return parameterDigest{}, nil, err
+	}
+
+	c.h.Reset()
+	c.h.Write(c.buf.Bytes())
+
+	var digest parameterDigest
+	c.h.Sum(digest[:0])
+	return digest, c.buf.Bytes(), nil
+}
+
+// parameterRefPrefix is the JSON pointer prefix used by every $ref into the top-level
+// "parameters" dictionary.
+const parameterRefPrefix = "#/parameters/"
+
+// resolveParameterRef looks up the parameter a $ref points at in sp.Parameters, the
+// dictionary callers may have pre-populated (for example by merging specs produced by
+// multiple contributors via pkg/aggregator). It returns an error only when the ref
+// can't be resolved at all, since that means the input spec is broken.
+func resolveParameterRef(sp *spec.Swagger, ref spec.Ref) (spec.Parameter, string, error) {
+	refStr := ref.String()
+	if !strings.HasPrefix(refStr, parameterRefPrefix) {
+		return spec.Parameter{}, "", fmt.Errorf("cannot resolve parameter ref %q: not a %s reference", refStr, parameterRefPrefix)
+	}
+
+	name := strings.TrimPrefix(refStr, parameterRefPrefix)
+	p, ok := sp.Parameters[name]
+	if !ok {
+		return spec.Parameter{}, "", fmt.Errorf("cannot resolve parameter ref %q: no such entry in the parameters dictionary", refStr)
+	}
+
+	return p, name, nil
+}
+
+// SharedParameterOptions controls how CollectSharedParametersWithOptions decides which
+// repeated parameters are worth lifting into the top-level "parameters" dictionary.
+type SharedParameterOptions struct {
+	// MinOccurrences is the number of times a distinct parameter must appear before
+	// it is promoted to a shared definition; parameters occurring fewer times are
+	// left inline. Values <= 1 promote every distinct parameter, matching the
+	// behavior of collectSharedParameters.
+	MinOccurrences int
+
+	// MaxNameLength, if positive, truncates the semantic part of a generated name
+	// (everything before the trailing "-<hash>") so the full name never exceeds it.
+	// When it is shorter than the "-<hash>" suffix itself, the semantic part is dropped
+	// and the name is that suffix alone, which is still longer than MaxNameLength.
+	MaxNameLength int
+
+	// NamePrefix, if set, is prepended to every generated shared parameter name.
+	NamePrefix string
+
+	// KeepInline, if set, is consulted for every parameter that otherwise meets
+	// MinOccurrences; returning true leaves that parameter inline regardless of how
+	// often it occurs.
+	KeepInline func(spec.Parameter) bool
+}
+
+// paramOccurrence tracks one distinct parameter value seen while collecting: its
+// canonical encoding (to defeat hash collisions between two different buckets sharing a
+// digest), the value itself, and how many times it occurred.
+type paramOccurrence struct {
+	digest    parameterDigest
+	canonical []byte
+	param     spec.Parameter
+	count     int
+}
+
+// sharedParameterName is one canonical-encoding-to-name mapping. namesByDigest below
+// keeps a slice of these per digest rather than a single name so that the rare hash
+// collision between two different parameters doesn't silently merge them.
+type sharedParameterName struct {
+	canonical []byte
+	name      string
+}
+
 // collectSharedParameters finds those parameters that show up often and hence can be
 // shared across all the paths to save space.
-func collectSharedParameters(sp *spec.Swagger) (namesByJSON map[string]string, ret map[string]spec.Parameter, err error) {
+func collectSharedParameters(sp *spec.Swagger) (namesByDigest map[parameterDigest][]sharedParameterName, ret map[string]spec.Parameter, err error) {
+	return CollectSharedParametersWithOptions(sp, nil)
+}
+
+// CollectSharedParametersWithOptions is collectSharedParameters with control over the
+// occurrence threshold, generated name shape, and per-parameter opt-out. A nil opts
+// promotes every distinct parameter exactly as collectSharedParameters does.
+func CollectSharedParametersWithOptions(sp *spec.Swagger, opts *SharedParameterOptions) (namesByDigest map[parameterDigest][]sharedParameterName, ret map[string]spec.Parameter, err error) {
 
 	if sp == nil || sp.Paths == nil {
 		return nil, nil, nil
 	}
 
-	countsByJSON := map[string]int{}
-	shared := map[string]spec.Parameter{}
-	var keys []string
+	byDigest := map[parameterDigest][]*paramOccurrence{}
+	var occurrences []*paramOccurrence
+	canon := newParameterCanonicalizer()
 
 	collect := func(p *spec.Parameter) error {
-		bs, err := json.Marshal(p)
+		digest, bs, err := canon.digest(p)
 		if err != nil {
 			return err
 		}
 
-		countsByJSON[string(bs)]++
-		if count := countsByJSON[string(bs)]; count == 1 {
-			shared[string(bs)] = *p
-			keys = append(keys, string(bs))
+		for _, occ := range byDigest[digest] {
+			if bytes.Equal(occ.canonical, bs) {
+				occ.count++
+				return nil
+			}
 		}
 
+		occ := &paramOccurrence{digest: digest, canonical: append([]byte(nil), bs...), param: *p, count: 1}
+		byDigest[digest] = append(byDigest[digest], occ)
+		occurrences = append(occurrences, occ)
 		return nil
 	}
 
@@ -61,8 +182,11 @@ func collectSharedParameters(sp *spec.Swagger) (namesByJSON map[string]string, r
 			}
 			for _, p := range op.Parameters {
 				if p.Ref.String() != "" {
-					// shouldn't happen, but ignore if it does
-					continue
+					resolved, _, err := resolveParameterRef(sp, p.Ref)
+					if err != nil {
+						return nil, nil, err
+					}
+					p = resolved
 				}
 				if err := collect(&p); err != nil {
 					return nil, nil, err
@@ -73,7 +197,11 @@ func collectSharedParameters(sp *spec.Swagger) (namesByJSON map[string]string, r
 		// per path parameters
 		for _, p := range path.Parameters {
 			if p.Ref.String() != "" {
-				continue // shouldn't happen, but ignore if it does
+				resolved, _, err := resolveParameterRef(sp, p.Ref)
+				if err != nil {
+					return nil, nil, err
+				}
+				p = resolved
 			}
 			if err := collect(&p); err != nil {
 				return nil, nil, err
@@ -81,29 +209,72 @@ func collectSharedParameters(sp *spec.Swagger) (namesByJSON map[string]string, r
 		}
 	}
 
-	// name deterministically
-	sort.Strings(keys)
+	minOccurrences := 1
+	var namePrefix string
+	var maxNameLength int
+	var keepInline func(spec.Parameter) bool
+	if opts != nil {
+		if opts.MinOccurrences > 1 {
+			minOccurrences = opts.MinOccurrences
+		}
+		namePrefix = opts.NamePrefix
+		maxNameLength = opts.MaxNameLength
+		keepInline = opts.KeepInline
+	}
+
+	// name deterministically: map iteration order over sp.Paths.Paths is random, so
+	// sort by the canonical encoding rather than relying on collection order.
+	sort.Slice(occurrences, func(i, j int) bool {
+		return bytes.Compare(occurrences[i].canonical, occurrences[j].canonical) < 0
+	})
+
 	ret = map[string]spec.Parameter{}
-	namesByJSON = map[string]string{}
-	for _, k := range keys {
-		name := shared[k].Name
-		if name == "" {
-			name = "param"
+	namesByDigest = map[parameterDigest][]sharedParameterName{}
+	for _, occ := range occurrences {
+		p := occ.param
+
+		if occ.count < minOccurrences {
+			continue
 		}
-		name += "-" + base64Hash(k)
+		if keepInline != nil && keepInline(p) {
+			continue
+		}
+
+		suffix := digestSuffix(occ.digest)
+
+		base := p.Name
+		if base == "" {
+			base = "param"
+		}
+		base = namePrefix + base
+		if maxNameLength > 0 {
+			hashSuffixLength := len("-" + suffix)
+			keepLen := maxNameLength - hashSuffixLength
+			if keepLen < 0 {
+				// The hash suffix alone is already longer than the configured
+				// maximum; there's no semantic part left to keep, so drop it
+				// entirely rather than silently skip truncation.
+				keepLen = 0
+			}
+			if keepLen < len(base) {
+				base = base[:keepLen]
+			}
+		}
+
+		name := base + "-" + suffix
 		i := 0
 		for {
 			if _, ok := ret[name]; !ok {
-				ret[name] = shared[k]
-				namesByJSON[k] = name
+				ret[name] = p
+				namesByDigest[occ.digest] = append(namesByDigest[occ.digest], sharedParameterName{canonical: occ.canonical, name: name})
 				break
 			}
 			i++ // only on hash conflict, unlikely with our few variants
-			name = shared[k].Name + "-" + strconv.Itoa(i)
+			name = base + "-" + strconv.Itoa(i)
 		}
 	}
 
-	return namesByJSON, ret, nil
+	return namesByDigest, ret, nil
 }
 
 func base64Hash(s string) string {
@@ -111,12 +282,65 @@ func base64Hash(s string) string {
 	return base64.URLEncoding.EncodeToString(hash[:6]) // 8 characters
 }
 
-func replaceSharedParameters(sharedParameterNamesByJSON map[string]string, sp *spec.Swagger) (*spec.Swagger, error) {
+// digestSuffix renders the first 6 bytes of a parameterDigest the same way base64Hash
+// renders a string hash, so names look the same regardless of which path produced them.
+func digestSuffix(d parameterDigest) string {
+	return base64.URLEncoding.EncodeToString(d[:6])
+}
+
+// replaceSharedParameters rewrites every parameter matching namesByDigest into a $ref at
+// the chosen shared name. Parameters that are already $refs are resolved and
+// canonicalized the same way, so the pass is idempotent whether a given occurrence
+// started out inline or pointing at a caller-supplied dictionary entry (for example one
+// contributed by a different spec merged in via pkg/aggregator). Dictionary entries
+// that end up with no remaining references because their occurrence was retargeted to
+// a different shared name are dropped from the returned spec.
+func replaceSharedParameters(namesByDigest map[parameterDigest][]sharedParameterName, sp *spec.Swagger) (*spec.Swagger, error) {
 	if sp == nil || sp.Paths == nil {
 		return sp, nil
 	}
 
 	ret := sp
+	retiredDictNames := map[string]bool{}
+	canon := newParameterCanonicalizer()
+
+	// canonicalize resolves p (inline or a $ref) against namesByDigest and reports
+	// the $ref it should become, or ok=false if nothing should change.
+	canonicalize := func(p spec.Parameter) (spec.Parameter, bool, error) {
+		origDictName := ""
+		if p.Ref.String() != "" {
+			resolved, dictName, err := resolveParameterRef(sp, p.Ref)
+			if err != nil {
+				return spec.Parameter{}, false, err
+			}
+			origDictName = dictName
+			p = resolved
+		}
+
+		digest, bs, err := canon.digest(&p)
+		if err != nil {
+			return spec.Parameter{}, false, err
+		}
+
+		name := ""
+		for _, candidate := range namesByDigest[digest] {
+			if bytes.Equal(candidate.canonical, bs) {
+				name = candidate.name
+				break
+			}
+		}
+		if name == "" {
+			return spec.Parameter{}, false, nil
+		}
+		if origDictName != "" && origDictName != name {
+			retiredDictNames[origDictName] = true
+		}
+		if origDictName == name {
+			return p, false, nil // already canonical
+		}
+
+		return spec.Parameter{Refable: spec.Refable{Ref: spec.MustCreateRef(parameterRefPrefix + name)}}, true, nil
+	}
 
 	firstPathChange := true
 	for k, path := range sp.Paths.Paths {
@@ -130,68 +354,48 @@ func replaceSharedParameters(sharedParameterNamesByJSON map[string]string, sp *s
 
 			firstParamChange := true
 			for i := range (*op).Parameters {
-				p := (*op).Parameters[i]
-
-				if p.Ref.String() != "" {
-					// shouldn't happen, but be idem-potent if it does
-					continue
-				}
-
-				bs, err := json.Marshal(p)
+				newParam, changed, err := canonicalize((*op).Parameters[i])
 				if err != nil {
 					return nil, err
 				}
+				if !changed {
+					continue
+				}
 
-				if name, ok := sharedParameterNamesByJSON[string(bs)]; ok {
-					if firstParamChange {
-						orig := *op
-						*op = &spec.Operation{}
-						**op = *orig
-						(*op).Parameters = make([]spec.Parameter, len(orig.Parameters))
-						copy((*op).Parameters, orig.Parameters)
-						firstParamChange = false
-					}
-
-					(*op).Parameters[i] = spec.Parameter{
-						Refable: spec.Refable{
-							Ref: spec.MustCreateRef("#/parameters/" + name),
-						},
-					}
-					pathChanged = true
+				if firstParamChange {
+					orig := *op
+					*op = &spec.Operation{}
+					**op = *orig
+					(*op).Parameters = make([]spec.Parameter, len(orig.Parameters))
+					copy((*op).Parameters, orig.Parameters)
+					firstParamChange = false
 				}
+
+				(*op).Parameters[i] = newParam
+				pathChanged = true
 			}
 		}
 
 		// per path parameters
 		firstParamChange := true
 		for i := range path.Parameters {
-			p := path.Parameters[i]
-
-			if p.Ref.String() != "" {
-				// shouldn't happen, but be idem-potent if it does
-				continue
-			}
-
-			bs, err := json.Marshal(p)
+			newParam, changed, err := canonicalize(path.Parameters[i])
 			if err != nil {
 				return nil, err
 			}
+			if !changed {
+				continue
+			}
 
-			if name, ok := sharedParameterNamesByJSON[string(bs)]; ok {
-				if firstParamChange {
-					orig := path.Parameters
-					path.Parameters = make([]spec.Parameter, len(orig))
-					copy(path.Parameters, orig)
-					firstParamChange = false
-				}
-
-				path.Parameters[i] = spec.Parameter{
-					Refable: spec.Refable{
-						Ref: spec.MustCreateRef("#/parameters/" + name),
-					},
-				}
-				pathChanged = true
+			if firstParamChange {
+				orig := path.Parameters
+				path.Parameters = make([]spec.Parameter, len(orig))
+				copy(path.Parameters, orig)
+				firstParamChange = false
 			}
+
+			path.Parameters[i] = newParam
+			pathChanged = true
 		}
 
 		if pathChanged {
@@ -213,5 +417,20 @@ func replaceSharedParameters(sharedParameterNamesByJSON map[string]string, sp *s
 		}
 	}
 
+	if len(retiredDictNames) > 0 {
+		if ret == sp {
+			clone := *sp
+			ret = &clone
+		}
+		dict := make(map[string]spec.Parameter, len(sp.Parameters))
+		for name, p := range sp.Parameters {
+			if retiredDictNames[name] {
+				continue
+			}
+			dict[name] = p
+		}
+		ret.Parameters = dict
+	}
+
 	return ret, nil
 }
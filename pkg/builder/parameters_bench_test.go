@@ -0,0 +1,92 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// kubeAPIServerLikeSpec builds a synthetic Swagger document shaped like a real
+// kube-apiserver spec: every operation carries a handful of heavily repeated query
+// parameters (pretty, dryRun, fieldManager, ...) plus one resource-specific parameter
+// that never repeats, so thresholding behavior can be measured without checking a
+// multi-megabyte fixture into the tree.
+func kubeAPIServerLikeSpec(numOperations int) *spec.Swagger {
+	paths := &spec.Paths{Paths: map[string]spec.PathItem{}}
+
+	commonParams := func(resource string) []spec.Parameter {
+		return []spec.Parameter{
+			{ParamProps: spec.ParamProps{Name: "pretty", In: "query", Description: "If true, then the output is pretty printed."}},
+			{ParamProps: spec.ParamProps{Name: "dryRun", In: "query", Description: "When present, indicates that modifications should not be persisted."}},
+			{ParamProps: spec.ParamProps{Name: "fieldManager", In: "query", Description: "Name associated with the actor or entity making these changes."}},
+			{ParamProps: spec.ParamProps{Name: "name", In: "path", Required: true, Description: fmt.Sprintf("name of the %s", resource)}},
+		}
+	}
+
+	for i := 0; i < numOperations; i++ {
+		resource := fmt.Sprintf("resource-%d", i)
+		op := &spec.Operation{
+			OperationProps: spec.OperationProps{
+				ID:         fmt.Sprintf("get-%s", resource),
+				Parameters: commonParams(resource),
+			},
+		}
+		paths.Paths[fmt.Sprintf("/api/v1/%s/{name}", resource)] = spec.PathItem{
+			PathItemProps: spec.PathItemProps{Get: op},
+		}
+	}
+
+	return &spec.Swagger{SwaggerProps: spec.SwaggerProps{Paths: paths}}
+}
+
+func benchmarkCollectSharedParametersThreshold(b *testing.B, minOccurrences int) {
+	sp := kubeAPIServerLikeSpec(2000)
+	opts := &SharedParameterOptions{MinOccurrences: minOccurrences}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var shared int
+	for i := 0; i < b.N; i++ {
+		_, ret, err := CollectSharedParametersWithOptions(sp, opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		shared = len(ret)
+	}
+
+	// Every operation repeats "name" uniquely (2000 occurrences, count 1 each) and
+	// three parameters that repeat 2000 times each. At MinOccurrences=1 all 2003
+	// distinct parameters would be lifted, bloating the dictionary with one-shot
+	// "name" entries; raising the threshold keeps only the genuinely shared ones.
+	b.ReportMetric(float64(shared), "shared-params")
+}
+
+func BenchmarkCollectSharedParametersMinOccurrences1(b *testing.B) {
+	benchmarkCollectSharedParametersThreshold(b, 1)
+}
+
+func BenchmarkCollectSharedParametersMinOccurrences2(b *testing.B) {
+	benchmarkCollectSharedParametersThreshold(b, 2)
+}
+
+func BenchmarkCollectSharedParametersMinOccurrences3(b *testing.B) {
+	benchmarkCollectSharedParametersThreshold(b, 3)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// marshalParameterDigest is the pre-streaming approach this package used to hash a
+// parameter: marshal it to a fresh []byte with encoding/json, then hash that. It is kept
+// here only as a benchmark baseline and a correctness oracle for parameterCanonicalizer.
+// The trailing newline matches what json.Encoder.Encode (used by parameterCanonicalizer)
+// writes, so the two hashing strategies agree byte-for-byte rather than merely producing
+// equivalent groupings.
+func marshalParameterDigest(p *spec.Parameter) (parameterDigest, error) {
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return parameterDigest{}, err
+	}
+	return sha256.Sum224(append(bs, '\n')), nil
+}
+
+// BenchmarkParameterHashMarshal hashes the same parameter repeatedly via json.Marshal,
+// allocating a fresh []byte every time.
+func BenchmarkParameterHashMarshal(b *testing.B) {
+	p := &spec.Parameter{ParamProps: spec.ParamProps{Name: "fieldManager", In: "query", Description: "Name associated with the actor or entity making these changes."}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := marshalParameterDigest(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParameterHashCanonicalizer hashes the same parameter repeatedly through a
+// single reused parameterCanonicalizer, the way collect and replace do across a whole
+// spec. It should allocate far less per op than BenchmarkParameterHashMarshal.
+func BenchmarkParameterHashCanonicalizer(b *testing.B) {
+	p := &spec.Parameter{ParamProps: spec.ParamProps{Name: "fieldManager", In: "query", Description: "Name associated with the actor or entity making these changes."}}
+	canon := newParameterCanonicalizer()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := canon.digest(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestCollectSharedParametersMatchesMarshalBaseline confirms that switching collection
+// and replacement over to the streaming canonicalizer didn't change which parameters get
+// shared or how references are rewritten: it recomputes the same dedup decision with the
+// old marshal-based hash and checks the two agree on every occurrence in the spec.
+func TestCollectSharedParametersMatchesMarshalBaseline(t *testing.T) {
+	sp := kubeAPIServerLikeSpec(25)
+
+	namesByDigest, params, err := collectSharedParameters(sp)
+	if err != nil {
+		t.Fatalf("collectSharedParameters: %v", err)
+	}
+
+	baseline := map[parameterDigest]spec.Parameter{}
+	for _, path := range sp.Paths.Paths {
+		for _, op := range []*spec.Operation{path.Get, path.Put, path.Post, path.Delete, path.Options, path.Head, path.Patch} {
+			if op == nil {
+				continue
+			}
+			for _, p := range op.Parameters {
+				digest, err := marshalParameterDigest(&p)
+				if err != nil {
+					t.Fatalf("marshalParameterDigest: %v", err)
+				}
+				baseline[digest] = p
+			}
+		}
+	}
+
+	for digest, names := range namesByDigest {
+		want, ok := baseline[digest]
+		if !ok {
+			t.Fatalf("canonicalizer produced digest %x that the marshal baseline never saw", digest)
+		}
+		for _, n := range names {
+			got, ok := params[n.name]
+			if !ok {
+				t.Fatalf("shared parameter %q missing from collected dictionary", n.name)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("shared parameter %q = %+v, marshal baseline = %+v", n.name, got, want)
+			}
+		}
+	}
+
+	replaced, err := replaceSharedParameters(namesByDigest, sp)
+	if err != nil {
+		t.Fatalf("replaceSharedParameters: %v", err)
+	}
+	for _, path := range replaced.Paths.Paths {
+		for _, op := range []*spec.Operation{path.Get, path.Put, path.Post, path.Delete, path.Options, path.Head, path.Patch} {
+			if op == nil {
+				continue
+			}
+			for _, p := range op.Parameters {
+				if p.Ref.String() == "" {
+					t.Fatalf("operation %s: parameter %q was not replaced with a $ref", op.ID, p.Name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// TestCollectSharedParametersWithOptionsMinOccurrences confirms MinOccurrences filters out
+// parameters that don't repeat often enough, leaving the rest of collectSharedParameters's
+// behavior untouched.
+func TestCollectSharedParametersWithOptionsMinOccurrences(t *testing.T) {
+	sp := kubeAPIServerLikeSpec(5)
+
+	_, ret, err := CollectSharedParametersWithOptions(sp, &SharedParameterOptions{MinOccurrences: 2})
+	if err != nil {
+		t.Fatalf("CollectSharedParametersWithOptions: %v", err)
+	}
+
+	// "pretty", "dryRun", and "fieldManager" repeat across all 5 operations; "name" is
+	// unique to each one and never reaches MinOccurrences=2.
+	if len(ret) != 3 {
+		t.Fatalf("expected 3 shared parameters at MinOccurrences=2, got %d: %+v", len(ret), ret)
+	}
+	for name := range ret {
+		if strings.HasPrefix(name, "name-") {
+			t.Fatalf("parameter %q should not have been shared below its occurrence threshold", name)
+		}
+	}
+}
+
+// TestCollectSharedParametersWithOptionsNamePrefix confirms NamePrefix is applied to every
+// generated name.
+func TestCollectSharedParametersWithOptionsNamePrefix(t *testing.T) {
+	sp := kubeAPIServerLikeSpec(5)
+
+	_, ret, err := CollectSharedParametersWithOptions(sp, &SharedParameterOptions{NamePrefix: "shared-"})
+	if err != nil {
+		t.Fatalf("CollectSharedParametersWithOptions: %v", err)
+	}
+	if len(ret) == 0 {
+		t.Fatalf("expected at least one shared parameter")
+	}
+	for name := range ret {
+		if !strings.HasPrefix(name, "shared-") {
+			t.Fatalf("expected every generated name to start with the configured prefix, got %q", name)
+		}
+	}
+}
+
+// TestCollectSharedParametersWithOptionsKeepInline confirms KeepInline opts a matching
+// parameter out of promotion even though it otherwise meets MinOccurrences.
+func TestCollectSharedParametersWithOptionsKeepInline(t *testing.T) {
+	sp := kubeAPIServerLikeSpec(5)
+
+	_, ret, err := CollectSharedParametersWithOptions(sp, &SharedParameterOptions{
+		KeepInline: func(p spec.Parameter) bool { return p.Name == "dryRun" },
+	})
+	if err != nil {
+		t.Fatalf("CollectSharedParametersWithOptions: %v", err)
+	}
+
+	for _, p := range ret {
+		if p.Name == "dryRun" {
+			t.Fatalf("expected dryRun to be kept inline, but it was promoted: %+v", ret)
+		}
+	}
+}
+
+// TestCollectSharedParametersWithOptionsMaxNameLength confirms MaxNameLength truncates the
+// semantic part of the name so the full name (including the "-<hash>" suffix) never
+// exceeds it, as long as the hash suffix itself fits within the limit.
+func TestCollectSharedParametersWithOptionsMaxNameLength(t *testing.T) {
+	sp := kubeAPIServerLikeSpec(5)
+
+	for _, maxLen := range []int{20, 9} {
+		_, ret, err := CollectSharedParametersWithOptions(sp, &SharedParameterOptions{MaxNameLength: maxLen})
+		if err != nil {
+			t.Fatalf("CollectSharedParametersWithOptions(MaxNameLength=%d): %v", maxLen, err)
+		}
+		if len(ret) == 0 {
+			t.Fatalf("expected at least one shared parameter")
+		}
+		for name := range ret {
+			if len(name) > maxLen {
+				t.Fatalf("MaxNameLength=%d: generated name %q is %d characters long", maxLen, name, len(name))
+			}
+		}
+	}
+}
+
+// TestCollectSharedParametersWithOptionsMaxNameLengthSmallerThanHash guards against a
+// regression where a MaxNameLength smaller than the "-<hash>" suffix alone made the
+// truncation arithmetic go negative (maxNameLength - hashSuffixLength < 0), which failed
+// the ">= 0" guard and silently skipped truncation entirely: the generated name came back
+// at its full, untruncated length despite the configured max. The suffix can't be shortened
+// further, so the best this can do is drop the semantic part entirely; it must not panic or
+// leave the semantic part untouched.
+func TestCollectSharedParametersWithOptionsMaxNameLengthSmallerThanHash(t *testing.T) {
+	sp := kubeAPIServerLikeSpec(5)
+
+	_, unbounded, err := CollectSharedParametersWithOptions(sp, nil)
+	if err != nil {
+		t.Fatalf("CollectSharedParametersWithOptions(nil): %v", err)
+	}
+
+	_, ret, err := CollectSharedParametersWithOptions(sp, &SharedParameterOptions{MaxNameLength: 1})
+	if err != nil {
+		t.Fatalf("CollectSharedParametersWithOptions(MaxNameLength=1): %v", err)
+	}
+	if len(ret) == 0 {
+		t.Fatalf("expected at least one shared parameter")
+	}
+
+	var longestUnbounded int
+	for name := range unbounded {
+		if len(name) > longestUnbounded {
+			longestUnbounded = len(name)
+		}
+	}
+
+	for name := range ret {
+		if len(name) >= longestUnbounded {
+			t.Fatalf("MaxNameLength=1: generated name %q (%d chars) was not shortened at all relative to the unbounded name length %d", name, len(name), longestUnbounded)
+		}
+	}
+}
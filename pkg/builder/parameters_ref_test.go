@@ -0,0 +1,109 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// TestReplaceSharedParametersConvergesRefAndInlineOccurrences exercises the scenario
+// resolveParameterRef exists for: a spec merged from multiple sources (for example by
+// pkg/aggregator) where one contributor already carries the parameter as a $ref into a
+// pre-populated sp.Parameters dictionary, while another still carries the identical
+// parameter inline. Both occurrences must canonicalize to the exact same shared name, and
+// the now-unreferenced original dictionary entry must be retired rather than left behind.
+func TestReplaceSharedParametersConvergesRefAndInlineOccurrences(t *testing.T) {
+	param := spec.Parameter{ParamProps: spec.ParamProps{Name: "fieldManager", In: "query"}}
+
+	sp := &spec.Swagger{SwaggerProps: spec.SwaggerProps{
+		Parameters: map[string]spec.Parameter{"existing": param},
+		Paths: &spec.Paths{Paths: map[string]spec.PathItem{
+			"/a": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{{Refable: spec.Refable{Ref: spec.MustCreateRef(parameterRefPrefix + "existing")}}},
+			}}}},
+			"/b": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{param},
+			}}}},
+		}},
+	}}
+
+	out, err := ReplaceSharedComponents(sp)
+	if err != nil {
+		t.Fatalf("ReplaceSharedComponents: %v", err)
+	}
+
+	refA := out.Paths.Paths["/a"].Get.Parameters[0].Ref.String()
+	refB := out.Paths.Paths["/b"].Get.Parameters[0].Ref.String()
+	if refA == "" || refB == "" {
+		t.Fatalf("expected both occurrences to be rewritten to a $ref, got %q and %q", refA, refB)
+	}
+	if refA != refB {
+		t.Fatalf("expected the $ref-based and inline occurrences to converge on the same shared name, got %q and %q", refA, refB)
+	}
+
+	if _, ok := out.Parameters["existing"]; ok {
+		t.Fatalf("expected the original dictionary entry %q to be retired once nothing referenced it by that name, got %+v", "existing", out.Parameters)
+	}
+
+	name, _, err := resolveParameterRef(out, out.Paths.Paths["/a"].Get.Parameters[0].Ref)
+	if err != nil {
+		t.Fatalf("resolveParameterRef: %v", err)
+	}
+	if !reflect.DeepEqual(name, param) {
+		t.Fatalf("resolved shared parameter = %+v, want %+v", name, param)
+	}
+}
+
+// TestReplaceSharedComponentsIdempotent confirms running ReplaceSharedComponents on its own
+// output is a no-op: every $ref it produced already resolves to its own canonical shared
+// name, so a second pass should neither add nor retire any dictionary entries nor rewrite
+// any further references.
+func TestReplaceSharedComponentsIdempotent(t *testing.T) {
+	param := spec.Parameter{ParamProps: spec.ParamProps{Name: "fieldManager", In: "query"}}
+
+	sp := &spec.Swagger{SwaggerProps: spec.SwaggerProps{
+		Parameters: map[string]spec.Parameter{"existing": param},
+		Paths: &spec.Paths{Paths: map[string]spec.PathItem{
+			"/a": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{{Refable: spec.Refable{Ref: spec.MustCreateRef(parameterRefPrefix + "existing")}}},
+			}}}},
+			"/b": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{param},
+			}}}},
+		}},
+	}}
+
+	once, err := ReplaceSharedComponents(sp)
+	if err != nil {
+		t.Fatalf("ReplaceSharedComponents (first pass): %v", err)
+	}
+
+	twice, err := ReplaceSharedComponents(once)
+	if err != nil {
+		t.Fatalf("ReplaceSharedComponents (second pass): %v", err)
+	}
+
+	if !reflect.DeepEqual(once.Parameters, twice.Parameters) {
+		t.Fatalf("second pass changed the parameters dictionary:\nfirst:  %+v\nsecond: %+v", once.Parameters, twice.Parameters)
+	}
+	if !reflect.DeepEqual(once.Paths, twice.Paths) {
+		t.Fatalf("second pass rewrote operation parameters that were already canonical:\nfirst:  %+v\nsecond: %+v", once.Paths, twice.Paths)
+	}
+}
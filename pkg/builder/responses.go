@@ -0,0 +1,204 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// collectSharedResponses finds those responses that show up often and hence can be
+// shared across all the operations to save space, the same way collectSharedParameters
+// does for parameters.
+func collectSharedResponses(sp *spec.Swagger) (namesByJSON map[string]string, ret map[string]spec.Response, err error) {
+
+	if sp == nil || sp.Paths == nil {
+		return nil, nil, nil
+	}
+
+	countsByJSON := map[string]int{}
+	shared := map[string]spec.Response{}
+	var keys []string
+
+	collect := func(r *spec.Response) error {
+		bs, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		countsByJSON[string(bs)]++
+		if count := countsByJSON[string(bs)]; count == 1 {
+			shared[string(bs)] = *r
+			keys = append(keys, string(bs))
+		}
+
+		return nil
+	}
+
+	for _, path := range sp.Paths.Paths {
+		for _, op := range []*spec.Operation{path.Get, path.Put, path.Post, path.Delete, path.Options, path.Head, path.Patch} {
+			if op == nil || op.Responses == nil {
+				continue // shouldn't happen, but ignore if it does
+			}
+
+			if op.Responses.Default != nil && op.Responses.Default.Ref.String() == "" {
+				if err := collect(op.Responses.Default); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			for code := range op.Responses.StatusCodeResponses {
+				r := op.Responses.StatusCodeResponses[code]
+				if r.Ref.String() != "" {
+					// shouldn't happen, but ignore if it does
+					continue
+				}
+				if err := collect(&r); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	// name deterministically
+	sort.Strings(keys)
+	ret = map[string]spec.Response{}
+	namesByJSON = map[string]string{}
+	for _, k := range keys {
+		if countsByJSON[k] <= 1 {
+			// A response that only occurs once would come back out strictly larger
+			// than it went in: a $ref plus a dictionary entry instead of the inline
+			// response. Leave it alone.
+			continue
+		}
+
+		name := "response"
+		name += "-" + base64Hash(k)
+		i := 0
+		for {
+			if _, ok := ret[name]; !ok {
+				ret[name] = shared[k]
+				namesByJSON[k] = name
+				break
+			}
+			i++ // only on hash conflict, unlikely with our few variants
+			name = "response-" + strconv.Itoa(i)
+		}
+	}
+
+	return namesByJSON, ret, nil
+}
+
+func replaceSharedResponses(sharedResponseNamesByJSON map[string]string, sp *spec.Swagger) (*spec.Swagger, error) {
+	if sp == nil || sp.Paths == nil {
+		return sp, nil
+	}
+
+	ret := sp
+
+	firstPathChange := true
+	for k, path := range sp.Paths.Paths {
+		pathChanged := false
+
+		for _, op := range []**spec.Operation{&path.Get, &path.Put, &path.Post, &path.Delete, &path.Options, &path.Head, &path.Patch} {
+			if *op == nil || (*op).Responses == nil {
+				continue
+			}
+
+			firstOpChange := true
+			cloneOp := func() {
+				if !firstOpChange {
+					return
+				}
+				orig := *op
+				*op = &spec.Operation{}
+				**op = *orig
+				respClone := *orig.Responses
+				(*op).Responses = &respClone
+				(*op).Responses.StatusCodeResponses = make(map[int]spec.Response, len(orig.Responses.StatusCodeResponses))
+				for code, r := range orig.Responses.StatusCodeResponses {
+					(*op).Responses.StatusCodeResponses[code] = r
+				}
+				firstOpChange = false
+			}
+
+			if (*op).Responses.Default != nil && (*op).Responses.Default.Ref.String() == "" {
+				bs, err := json.Marshal((*op).Responses.Default)
+				if err != nil {
+					return nil, err
+				}
+
+				if name, ok := sharedResponseNamesByJSON[string(bs)]; ok {
+					cloneOp()
+					(*op).Responses.Default = &spec.Response{
+						Refable: spec.Refable{
+							Ref: spec.MustCreateRef("#/responses/" + name),
+						},
+					}
+					pathChanged = true
+				}
+			}
+
+			for code := range (*op).Responses.StatusCodeResponses {
+				r := (*op).Responses.StatusCodeResponses[code]
+
+				if r.Ref.String() != "" {
+					// shouldn't happen, but be idem-potent if it does
+					continue
+				}
+
+				bs, err := json.Marshal(r)
+				if err != nil {
+					return nil, err
+				}
+
+				if name, ok := sharedResponseNamesByJSON[string(bs)]; ok {
+					cloneOp()
+					(*op).Responses.StatusCodeResponses[code] = spec.Response{
+						Refable: spec.Refable{
+							Ref: spec.MustCreateRef("#/responses/" + name),
+						},
+					}
+					pathChanged = true
+				}
+			}
+		}
+
+		if pathChanged {
+			if firstPathChange {
+				clone := *sp
+				ret = &clone
+
+				pathsClone := *ret.Paths
+				ret.Paths = &pathsClone
+
+				ret.Paths.Paths = make(map[string]spec.PathItem, len(sp.Paths.Paths))
+				for k, v := range sp.Paths.Paths {
+					ret.Paths.Paths[k] = v
+				}
+
+				firstPathChange = false
+			}
+			ret.Paths.Paths[k] = path
+		}
+	}
+
+	return ret, nil
+}
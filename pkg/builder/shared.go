@@ -0,0 +1,113 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// ReplaceSharedComponents rewrites sp so that parameters, responses, and inline schema
+// fragments that are repeated across operations are promoted to the top-level
+// "parameters", "responses", and "definitions" containers and referenced via $ref in
+// place, the same way go-openapi/analysis's flatten stage factors out common
+// structures. It is safe to call repeatedly; sp itself is never mutated, and a pointer
+// to it is returned unchanged when nothing was shared.
+//
+// Definitions run first, while body parameters and responses are still inline:
+// collectSharedDefinitions skips any parameter or response that is already a $ref, and
+// collectSharedParameters and collectSharedResponses replace what they promote with
+// $refs, so running either of them first would turn body parameters and responses into
+// $refs before collectSharedDefinitions ever got a chance to look at the schema nested
+// inside them.
+func ReplaceSharedComponents(sp *spec.Swagger) (*spec.Swagger, error) {
+	namesByJSON, definitions, err := collectSharedDefinitions(sp)
+	if err != nil {
+		return nil, err
+	}
+	if len(definitions) > 0 {
+		if sp, err = replaceSharedDefinitions(namesByJSON, sp); err != nil {
+			return nil, err
+		}
+		sp = withDefinitions(sp, definitions)
+	}
+
+	namesByDigest, params, err := collectSharedParameters(sp)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		if sp, err = replaceSharedParameters(namesByDigest, sp); err != nil {
+			return nil, err
+		}
+		sp = withParameters(sp, params)
+	}
+
+	namesByJSON, responses, err := collectSharedResponses(sp)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) > 0 {
+		if sp, err = replaceSharedResponses(namesByJSON, sp); err != nil {
+			return nil, err
+		}
+		sp = withResponses(sp, responses)
+	}
+
+	return sp, nil
+}
+
+func withParameters(sp *spec.Swagger, params map[string]spec.Parameter) *spec.Swagger {
+	ret := make(map[string]spec.Parameter, len(sp.Parameters)+len(params))
+	for k, v := range sp.Parameters {
+		ret[k] = v
+	}
+	for k, v := range params {
+		ret[k] = v
+	}
+
+	clone := *sp
+	clone.Parameters = ret
+	return &clone
+}
+
+func withResponses(sp *spec.Swagger, responses map[string]spec.Response) *spec.Swagger {
+	ret := make(map[string]spec.Response, len(sp.Responses)+len(responses))
+	for k, v := range sp.Responses {
+		ret[k] = v
+	}
+	for k, v := range responses {
+		ret[k] = v
+	}
+
+	clone := *sp
+	clone.Responses = ret
+	return &clone
+}
+
+func withDefinitions(sp *spec.Swagger, definitions map[string]spec.Schema) *spec.Swagger {
+	ret := make(spec.Definitions, len(sp.Definitions)+len(definitions))
+	for k, v := range sp.Definitions {
+		ret[k] = v
+	}
+	for k, v := range definitions {
+		ret[k] = v
+	}
+
+	clone := *sp
+	clone.Definitions = ret
+	return &clone
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// bodyParamSchema returns a fresh copy of a schema nested under a body parameter, so two
+// calls produce equal-but-distinct values the way two independent operations would.
+func bodyParamSchema() *spec.Schema {
+	return &spec.Schema{SchemaProps: spec.SchemaProps{ID: "Pod", Properties: map[string]spec.Schema{"name": {}}}}
+}
+
+// TestReplaceSharedComponentsSharesBodyParameterSchemas guards against a regression
+// where the definitions pass ran after the parameters pass: since collectSharedParameters
+// (opts=nil) promotes every distinct parameter regardless of occurrence count, every body
+// parameter became a $ref before collectSharedDefinitions ever got to look at the schema
+// nested inside it, so identical body schemas across operations were never deduped.
+func TestReplaceSharedComponentsSharesBodyParameterSchemas(t *testing.T) {
+	sp := &spec.Swagger{SwaggerProps: spec.SwaggerProps{
+		Paths: &spec.Paths{Paths: map[string]spec.PathItem{
+			"/a": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{{ParamProps: spec.ParamProps{Name: "bodyA", In: "body"}, Schema: bodyParamSchema()}},
+			}}}},
+			"/b": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{{ParamProps: spec.ParamProps{Name: "bodyB", In: "body"}, Schema: bodyParamSchema()}},
+			}}}},
+		}},
+	}}
+
+	out, err := ReplaceSharedComponents(sp)
+	if err != nil {
+		t.Fatalf("ReplaceSharedComponents: %v", err)
+	}
+
+	if len(out.Definitions) == 0 {
+		t.Fatalf("expected the identical body schema to be promoted to a shared definition, got none")
+	}
+
+	// Both distinct-named body parameters get promoted to #/parameters/... too (the
+	// unconfigured collectSharedParameters promotes every parameter regardless of
+	// occurrence count), so what's left on each operation is a $ref to the parameter
+	// dictionary rather than the inline parameter itself; the schema sharing this test
+	// guards shows up one level down, in the dictionary entries' Schema field.
+	for name, p := range out.Parameters {
+		if p.Schema == nil || p.Schema.Ref.String() == "" {
+			t.Fatalf("shared parameter %q: body schema was not rewritten to a $ref: %+v", name, p.Schema)
+		}
+	}
+}
+
+// TestCollectSharedResponsesRequiresMoreThanOneOccurrence confirms a response that shows
+// up exactly once is left inline: promoting it would add a dictionary entry and a $ref in
+// its place without removing anything, making the document larger rather than smaller.
+func TestCollectSharedResponsesRequiresMoreThanOneOccurrence(t *testing.T) {
+	sp := &spec.Swagger{SwaggerProps: spec.SwaggerProps{
+		Paths: &spec.Paths{Paths: map[string]spec.PathItem{
+			"/a": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Responses: &spec.Responses{ResponsesProps: spec.ResponsesProps{
+					Default: &spec.Response{Schema: &spec.Schema{SchemaProps: spec.SchemaProps{ID: "OnlyOnce"}}},
+				}},
+			}}}},
+		}},
+	}}
+
+	_, ret, err := collectSharedResponses(sp)
+	if err != nil {
+		t.Fatalf("collectSharedResponses: %v", err)
+	}
+	if len(ret) != 0 {
+		t.Fatalf("expected a singleton response to be left inline, got %d shared entries", len(ret))
+	}
+}
+
+// TestCollectSharedDefinitionsRequiresMoreThanOneOccurrence is the definitions-side
+// counterpart of TestCollectSharedResponsesRequiresMoreThanOneOccurrence.
+func TestCollectSharedDefinitionsRequiresMoreThanOneOccurrence(t *testing.T) {
+	sp := &spec.Swagger{SwaggerProps: spec.SwaggerProps{
+		Paths: &spec.Paths{Paths: map[string]spec.PathItem{
+			"/a": {PathItemProps: spec.PathItemProps{Get: &spec.Operation{OperationProps: spec.OperationProps{
+				Parameters: []spec.Parameter{{ParamProps: spec.ParamProps{Name: "bodyA", In: "body"}, Schema: bodyParamSchema()}},
+			}}}},
+		}},
+	}}
+
+	_, ret, err := collectSharedDefinitions(sp)
+	if err != nil {
+		t.Fatalf("collectSharedDefinitions: %v", err)
+	}
+	if len(ret) != 0 {
+		t.Fatalf("expected a singleton schema to be left inline, got %d shared entries", len(ret))
+	}
+}
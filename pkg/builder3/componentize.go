@@ -0,0 +1,129 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package builder3 supports the componentization of OpenAPI v3 documents: promoting
+// parameters, responses, request bodies, headers and schemas that are repeated across
+// operations into the document's top-level "components" object, the v3 counterpart of
+// what pkg/builder does for the "parameters" section of a v2 Swagger document.
+package builder3
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+// Componentize returns a copy of doc in which every parameter, response, request body,
+// header, and inline schema that shows up more than once across its operations is
+// lifted into Components and referenced via $ref where it occurred, the same "flatten
+// common structures" approach collectSharedParameters uses for v2 Swagger documents.
+// doc itself is not modified. Headers are counted only inside responses that stay
+// inline; a promoted response keeps its headers inline in its component.
+//
+// Schemas run first, while parameters, request bodies, and responses are still inline:
+// schemaRootsOf skips anything already behind a $ref, so running any of the other three
+// passes first would hide their nested schemas from collectSharedSchemas as soon as
+// those passes promoted the parameter/body/response wrapping them.
+func Componentize(doc *openapi.OpenAPI) (*openapi.OpenAPI, error) {
+	if doc == nil || doc.Paths == nil {
+		return doc, nil
+	}
+
+	ret := doc
+
+	namesByJSON, schemas, err := collectSharedSchemas(ret)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemas) > 0 {
+		if ret, err = replaceSharedSchemas(namesByJSON, ret); err != nil {
+			return nil, err
+		}
+		ret = withComponents(ret, func(c *openapi.Components) { c.Schemas = mergeSchemas(c.Schemas, schemas) })
+	}
+
+	namesByJSON, params, err := collectSharedParameters(ret)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		if ret, err = replaceSharedParameters(namesByJSON, ret); err != nil {
+			return nil, err
+		}
+		ret = withComponents(ret, func(c *openapi.Components) { c.Parameters = mergeParameters(c.Parameters, params) })
+	}
+
+	namesByJSON, bodies, err := collectSharedRequestBodies(ret)
+	if err != nil {
+		return nil, err
+	}
+	if len(bodies) > 0 {
+		if ret, err = replaceSharedRequestBodies(namesByJSON, ret); err != nil {
+			return nil, err
+		}
+		ret = withComponents(ret, func(c *openapi.Components) { c.RequestBodies = mergeRequestBodies(c.RequestBodies, bodies) })
+	}
+
+	namesByJSON, responses, headerNamesByJSON, headers, err := collectSharedResponses(ret)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) > 0 || len(headers) > 0 {
+		if ret, err = replaceSharedResponses(namesByJSON, headerNamesByJSON, ret); err != nil {
+			return nil, err
+		}
+		ret = withComponents(ret, func(c *openapi.Components) {
+			c.Responses = mergeResponses(c.Responses, responses)
+			c.Headers = mergeHeaders(c.Headers, headers)
+		})
+	}
+
+	return ret, nil
+}
+
+// withComponents clones doc and its Components object (allocating one if doc didn't
+// already have it) and applies fill, so callers never mutate the caller's document.
+func withComponents(doc *openapi.OpenAPI, fill func(*openapi.Components)) *openapi.OpenAPI {
+	clone := *doc
+
+	var components openapi.Components
+	if clone.Components != nil {
+		components = *clone.Components
+	}
+	fill(&components)
+	clone.Components = &components
+
+	return &clone
+}
+
+// componentName picks a deterministic name for a shared component: a semantic prefix
+// plus a short hash of its canonical JSON, falling back to a numeric suffix on the rare
+// hash collision between two different values that happen to share a prefix.
+func componentName(prefix, json string, taken func(name string) bool) string {
+	base := prefix + "-" + base64Hash(json)
+	name := base
+	for i := 1; taken(name); i++ {
+		name = base + "-" + strconv.Itoa(i) // only on hash conflict, unlikely with our few variants
+	}
+	return name
+}
+
+func base64Hash(s string) string {
+	hash := sha256.Sum224([]byte(s))
+	return base64.URLEncoding.EncodeToString(hash[:6]) // 8 characters
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder3
+
+import (
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+// twoPathDocWithSharedParameter builds the smallest document that exercises sharing: two
+// paths, each with a single Get operation, both carrying an identical inline "name"
+// parameter.
+func twoPathDocWithSharedParameter() *openapi.OpenAPI {
+	param := func() *openapi.Parameter {
+		return &openapi.Parameter{Name: "name"}
+	}
+
+	return &openapi.OpenAPI{
+		Paths: &openapi.Paths{
+			Paths: map[string]*openapi.Path{
+				"/a": {Get: &openapi.Operation{Parameters: []*openapi.Parameter{param()}}},
+				"/b": {Get: &openapi.Operation{Parameters: []*openapi.Parameter{param()}}},
+			},
+		},
+	}
+}
+
+// TestComponentizeRewritesOperationParameterRefs guards against a regression where
+// replaceSharedParameters cloned a path's operation but wrote the clone back into the
+// original, caller-owned *openapi.Path instead of the new document being built: the
+// returned document kept the stale inline parameter (no $ref), while doc.Components
+// still gained an entry, making the componentized document strictly larger than the
+// input it started from.
+func TestComponentizeRewritesOperationParameterRefs(t *testing.T) {
+	doc := twoPathDocWithSharedParameter()
+
+	out, err := Componentize(doc)
+	if err != nil {
+		t.Fatalf("Componentize: %v", err)
+	}
+
+	if out.Components == nil || len(out.Components.Parameters) != 1 {
+		t.Fatalf("expected exactly one shared parameter, got %+v", out.Components)
+	}
+
+	for _, key := range []string{"/a", "/b"} {
+		p := out.Paths.Paths[key].Get.Parameters[0]
+		if p.Ref.String() == "" {
+			t.Fatalf("path %s: operation parameter was not rewritten to a $ref: %+v", key, p)
+		}
+	}
+
+	for _, key := range []string{"/a", "/b"} {
+		p := doc.Paths.Paths[key].Get.Parameters[0]
+		if p.Ref.String() != "" {
+			t.Fatalf("path %s: Componentize mutated the caller's input document in place", key)
+		}
+	}
+}
+
+// TestComponentizeLeavesSingletonsInline guards against promoting a value that only
+// occurs once: a $ref plus a one-entry components dictionary is strictly larger than
+// the inline value it replaces, for every one of parameters, request bodies, responses,
+// and schemas.
+func TestComponentizeLeavesSingletonsInline(t *testing.T) {
+	doc := &openapi.OpenAPI{
+		Paths: &openapi.Paths{
+			Paths: map[string]*openapi.Path{
+				"/a": {
+					Get: &openapi.Operation{
+						Parameters: []*openapi.Parameter{{Name: "onlyA"}},
+						Responses: &openapi.Responses{
+							Default: &openapi.Response{Content: map[string]*openapi.MediaType{
+								"application/json": {Schema: &spec.Schema{SchemaProps: spec.SchemaProps{ID: "OnlyA"}}},
+							}},
+						},
+					},
+					Post: &openapi.Operation{
+						RequestBody: &openapi.RequestBody{Content: map[string]*openapi.MediaType{
+							"application/json": {Schema: &spec.Schema{SchemaProps: spec.SchemaProps{ID: "OnlyB"}}},
+						}},
+					},
+				},
+			},
+		},
+	}
+
+	out, err := Componentize(doc)
+	if err != nil {
+		t.Fatalf("Componentize: %v", err)
+	}
+
+	if out.Components != nil {
+		t.Fatalf("expected no components for a document with no repeated values, got %+v", out.Components)
+	}
+}
+
+// sharedSchema is the schema TestComponentizeSharesSchemaAcrossRequestBodyAndResponse
+// duplicates across a request body and a response.
+func sharedSchema() *spec.Schema {
+	return &spec.Schema{SchemaProps: spec.SchemaProps{ID: "Widget", Properties: map[string]spec.Schema{"name": {}}}}
+}
+
+// TestComponentizeSharesSchemaAcrossRequestBodyAndResponse guards against a regression
+// where collectSharedSchemas ran after the request body and response passes: since
+// schemaRootsOf skips anything already behind a $ref, a schema duplicated across a
+// request body (itself repeated, so promoted to #/components/requestBodies) and a
+// response (itself repeated, so promoted to #/components/responses) became invisible to
+// the schema pass the moment those wrapping values were promoted, and never got shared.
+func TestComponentizeSharesSchemaAcrossRequestBodyAndResponse(t *testing.T) {
+	mediaType := func() map[string]*openapi.MediaType {
+		return map[string]*openapi.MediaType{"application/json": {Schema: sharedSchema()}}
+	}
+
+	doc := &openapi.OpenAPI{
+		Paths: &openapi.Paths{
+			Paths: map[string]*openapi.Path{
+				"/a": {Post: &openapi.Operation{RequestBody: &openapi.RequestBody{Content: mediaType()}}},
+				"/b": {Post: &openapi.Operation{RequestBody: &openapi.RequestBody{Content: mediaType()}}},
+				"/c": {Get: &openapi.Operation{Responses: &openapi.Responses{Default: &openapi.Response{Content: mediaType()}}}},
+				"/d": {Get: &openapi.Operation{Responses: &openapi.Responses{Default: &openapi.Response{Content: mediaType()}}}},
+			},
+		},
+	}
+
+	out, err := Componentize(doc)
+	if err != nil {
+		t.Fatalf("Componentize: %v", err)
+	}
+
+	if out.Components == nil {
+		t.Fatalf("expected the schema duplicated across request bodies and responses to be shared, got no components at all")
+	}
+
+	var found bool
+	for _, s := range out.Components.Schemas {
+		if s.ID == "Widget" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected a shared schema with ID %q, got %+v", "Widget", out.Components.Schemas)
+	}
+}
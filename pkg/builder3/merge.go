@@ -0,0 +1,77 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder3
+
+import (
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+func mergeParameters(base map[string]*openapi.Parameter, additions map[string]*openapi.Parameter) map[string]*openapi.Parameter {
+	ret := make(map[string]*openapi.Parameter, len(base)+len(additions))
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range additions {
+		ret[k] = v
+	}
+	return ret
+}
+
+func mergeRequestBodies(base map[string]*openapi.RequestBody, additions map[string]*openapi.RequestBody) map[string]*openapi.RequestBody {
+	ret := make(map[string]*openapi.RequestBody, len(base)+len(additions))
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range additions {
+		ret[k] = v
+	}
+	return ret
+}
+
+func mergeResponses(base map[string]*openapi.Response, additions map[string]*openapi.Response) map[string]*openapi.Response {
+	ret := make(map[string]*openapi.Response, len(base)+len(additions))
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range additions {
+		ret[k] = v
+	}
+	return ret
+}
+
+func mergeHeaders(base map[string]*openapi.Header, additions map[string]*openapi.Header) map[string]*openapi.Header {
+	ret := make(map[string]*openapi.Header, len(base)+len(additions))
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range additions {
+		ret[k] = v
+	}
+	return ret
+}
+
+func mergeSchemas(base map[string]*spec.Schema, additions map[string]*spec.Schema) map[string]*spec.Schema {
+	ret := make(map[string]*spec.Schema, len(base)+len(additions))
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range additions {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder3
+
+import (
+	"encoding/json"
+	"sort"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+// operationsOf returns the per-method operations of a v3 path item, mirroring the
+// fixed-order walk pkg/builder uses for v2 PathItems.
+func operationsOf(path *openapi.Path) []*openapi.Operation {
+	return []*openapi.Operation{path.Get, path.Put, path.Post, path.Delete, path.Options, path.Head, path.Patch, path.Trace}
+}
+
+// pathOperationSlot gets or sets one per-method operation field on a *openapi.Path.
+// replace* passes over doc.Paths.Paths use these instead of capturing `&clonedPath.Get`
+// (etc.) directly, because clonedPath is only reassigned to a fresh clone lazily, the
+// first time something in the path actually changes: a pointer taken before that
+// reassignment keeps referring to the original, shared Path struct, so a later write
+// through it would silently mutate the caller's input document instead of the clone.
+// Calling get/set through clonedPath itself (rather than a pre-resolved address)
+// guarantees every access sees whichever struct clonedPath currently points at.
+type pathOperationSlot struct {
+	get func(*openapi.Path) *openapi.Operation
+	set func(*openapi.Path, *openapi.Operation)
+}
+
+var pathOperationSlots = []pathOperationSlot{
+	{func(p *openapi.Path) *openapi.Operation { return p.Get }, func(p *openapi.Path, op *openapi.Operation) { p.Get = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Put }, func(p *openapi.Path, op *openapi.Operation) { p.Put = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Post }, func(p *openapi.Path, op *openapi.Operation) { p.Post = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Delete }, func(p *openapi.Path, op *openapi.Operation) { p.Delete = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Options }, func(p *openapi.Path, op *openapi.Operation) { p.Options = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Head }, func(p *openapi.Path, op *openapi.Operation) { p.Head = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Patch }, func(p *openapi.Path, op *openapi.Operation) { p.Patch = op }},
+	{func(p *openapi.Path) *openapi.Operation { return p.Trace }, func(p *openapi.Path, op *openapi.Operation) { p.Trace = op }},
+}
+
+// collectSharedParameters finds parameters that show up more than once across doc's
+// operations and hence can be shared via doc.Components.Parameters.
+func collectSharedParameters(doc *openapi.OpenAPI) (namesByJSON map[string]string, ret map[string]*openapi.Parameter, err error) {
+	if doc == nil || doc.Paths == nil {
+		return nil, nil, nil
+	}
+
+	countsByJSON := map[string]int{}
+	shared := map[string]*openapi.Parameter{}
+	var keys []string
+
+	collect := func(p *openapi.Parameter) error {
+		bs, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+
+		countsByJSON[string(bs)]++
+		if count := countsByJSON[string(bs)]; count == 1 {
+			shared[string(bs)] = p
+			keys = append(keys, string(bs))
+		}
+
+		return nil
+	}
+
+	for _, path := range doc.Paths.Paths {
+		for _, op := range operationsOf(path) {
+			if op == nil {
+				continue
+			}
+			for _, p := range op.Parameters {
+				if p == nil || p.Ref.String() != "" {
+					continue
+				}
+				if err := collect(p); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		for _, p := range path.Parameters {
+			if p == nil || p.Ref.String() != "" {
+				continue
+			}
+			if err := collect(p); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	ret = map[string]*openapi.Parameter{}
+	namesByJSON = map[string]string{}
+	for _, k := range keys {
+		if countsByJSON[k] <= 1 {
+			// A parameter that only occurs once would come back out strictly larger
+			// than it went in: a $ref plus a dictionary entry instead of the inline
+			// parameter. Leave it alone.
+			continue
+		}
+
+		prefix := shared[k].Name
+		if prefix == "" {
+			prefix = "param"
+		}
+		name := componentName(prefix, k, func(n string) bool { _, ok := ret[n]; return ok })
+		ret[name] = shared[k]
+		namesByJSON[k] = name
+	}
+
+	return namesByJSON, ret, nil
+}
+
+func replaceSharedParameters(namesByJSON map[string]string, doc *openapi.OpenAPI) (*openapi.OpenAPI, error) {
+	if doc == nil || doc.Paths == nil {
+		return doc, nil
+	}
+
+	ret := doc
+	firstDocChange := true
+
+	for k, path := range doc.Paths.Paths {
+		pathChanged := false
+		clonedPath := path
+
+		clonePath := func() {
+			if clonedPath != path {
+				return
+			}
+			p := *path
+			clonedPath = &p
+		}
+
+		for _, slot := range pathOperationSlots {
+			origOp := slot.get(clonedPath)
+			if origOp == nil {
+				continue
+			}
+
+			var newParams []*openapi.Parameter
+			opChanged := false
+
+			for i, p := range origOp.Parameters {
+				if p == nil || p.Ref.String() != "" {
+					continue
+				}
+
+				bs, err := json.Marshal(p)
+				if err != nil {
+					return nil, err
+				}
+
+				if name, ok := namesByJSON[string(bs)]; ok {
+					if newParams == nil {
+						newParams = make([]*openapi.Parameter, len(origOp.Parameters))
+						copy(newParams, origOp.Parameters)
+					}
+					newParams[i] = &openapi.Parameter{Refable: spec.Refable{Ref: spec.MustCreateRef("#/components/parameters/" + name)}}
+					opChanged = true
+				}
+			}
+
+			if opChanged {
+				clonePath()
+				clonedOp := *origOp
+				clonedOp.Parameters = newParams
+				slot.set(clonedPath, &clonedOp)
+				pathChanged = true
+			}
+		}
+
+		var newPathParams []*openapi.Parameter
+		for i, p := range clonedPath.Parameters {
+			if p == nil || p.Ref.String() != "" {
+				continue
+			}
+
+			bs, err := json.Marshal(p)
+			if err != nil {
+				return nil, err
+			}
+
+			if name, ok := namesByJSON[string(bs)]; ok {
+				if newPathParams == nil {
+					newPathParams = make([]*openapi.Parameter, len(clonedPath.Parameters))
+					copy(newPathParams, clonedPath.Parameters)
+				}
+				newPathParams[i] = &openapi.Parameter{Refable: spec.Refable{Ref: spec.MustCreateRef("#/components/parameters/" + name)}}
+			}
+		}
+		if newPathParams != nil {
+			clonePath()
+			clonedPath.Parameters = newPathParams
+			pathChanged = true
+		}
+
+		if pathChanged {
+			if firstDocChange {
+				docClone := *doc
+				ret = &docClone
+
+				pathsClone := *ret.Paths
+				ret.Paths = &pathsClone
+
+				ret.Paths.Paths = make(map[string]*openapi.Path, len(doc.Paths.Paths))
+				for pk, pv := range doc.Paths.Paths {
+					ret.Paths.Paths[pk] = pv
+				}
+
+				firstDocChange = false
+			}
+			ret.Paths.Paths[k] = clonedPath
+		}
+	}
+
+	return ret, nil
+}
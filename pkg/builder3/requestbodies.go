@@ -0,0 +1,138 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder3
+
+import (
+	"encoding/json"
+	"sort"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+// collectSharedRequestBodies finds request bodies that show up more than once across
+// doc's operations and hence can be shared via doc.Components.RequestBodies.
+func collectSharedRequestBodies(doc *openapi.OpenAPI) (namesByJSON map[string]string, ret map[string]*openapi.RequestBody, err error) {
+	if doc == nil || doc.Paths == nil {
+		return nil, nil, nil
+	}
+
+	countsByJSON := map[string]int{}
+	shared := map[string]*openapi.RequestBody{}
+	var keys []string
+
+	for _, path := range doc.Paths.Paths {
+		for _, op := range operationsOf(path) {
+			if op == nil || op.RequestBody == nil || op.RequestBody.Ref.String() != "" {
+				continue
+			}
+
+			bs, err := json.Marshal(op.RequestBody)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			countsByJSON[string(bs)]++
+			if count := countsByJSON[string(bs)]; count == 1 {
+				shared[string(bs)] = op.RequestBody
+				keys = append(keys, string(bs))
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	ret = map[string]*openapi.RequestBody{}
+	namesByJSON = map[string]string{}
+	for _, k := range keys {
+		if countsByJSON[k] <= 1 {
+			// A request body that only occurs once would come back out strictly
+			// larger than it went in: a $ref plus a dictionary entry instead of the
+			// inline body. Leave it alone.
+			continue
+		}
+
+		name := componentName("body", k, func(n string) bool { _, ok := ret[n]; return ok })
+		ret[name] = shared[k]
+		namesByJSON[k] = name
+	}
+
+	return namesByJSON, ret, nil
+}
+
+func replaceSharedRequestBodies(namesByJSON map[string]string, doc *openapi.OpenAPI) (*openapi.OpenAPI, error) {
+	if doc == nil || doc.Paths == nil {
+		return doc, nil
+	}
+
+	ret := doc
+	firstDocChange := true
+
+	for k, path := range doc.Paths.Paths {
+		pathChanged := false
+		clonedPath := path
+		clonePath := func() {
+			if clonedPath != path {
+				return
+			}
+			p := *path
+			clonedPath = &p
+		}
+
+		for _, slot := range pathOperationSlots {
+			op := slot.get(clonedPath)
+			if op == nil || op.RequestBody == nil || op.RequestBody.Ref.String() != "" {
+				continue
+			}
+
+			bs, err := json.Marshal(op.RequestBody)
+			if err != nil {
+				return nil, err
+			}
+
+			name, ok := namesByJSON[string(bs)]
+			if !ok {
+				continue
+			}
+
+			clonePath()
+			clonedOp := *op
+			clonedOp.RequestBody = &openapi.RequestBody{Refable: spec.Refable{Ref: spec.MustCreateRef("#/components/requestBodies/" + name)}}
+			slot.set(clonedPath, &clonedOp)
+			pathChanged = true
+		}
+
+		if pathChanged {
+			if firstDocChange {
+				docClone := *doc
+				ret = &docClone
+
+				pathsClone := *ret.Paths
+				ret.Paths = &pathsClone
+
+				ret.Paths.Paths = make(map[string]*openapi.Path, len(doc.Paths.Paths))
+				for pk, pv := range doc.Paths.Paths {
+					ret.Paths.Paths[pk] = pv
+				}
+
+				firstDocChange = false
+			}
+			ret.Paths.Paths[k] = clonedPath
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder3
+
+import (
+	"encoding/json"
+	"sort"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+// collectSharedResponses finds responses, and the headers nested inside them, that show
+// up more than once across doc's operations and hence can be shared via
+// doc.Components.Responses and doc.Components.Headers respectively. A response that is
+// itself promoted keeps its headers inline in the shared definition; only headers
+// reachable from a response that stays put are considered for their own promotion.
+func collectSharedResponses(doc *openapi.OpenAPI) (namesByJSON map[string]string, responses map[string]*openapi.Response, headerNamesByJSON map[string]string, headers map[string]*openapi.Header, err error) {
+	if doc == nil || doc.Paths == nil {
+		return nil, nil, nil, nil, nil
+	}
+
+	respCountsByJSON := map[string]int{}
+	sharedResp := map[string]*openapi.Response{}
+	var respKeys []string
+
+	headerCountsByJSON := map[string]int{}
+	sharedHeaders := map[string]*openapi.Header{}
+	var headerKeys []string
+
+	// firstSeen holds each distinct response once; its headers are counted after all
+	// responses have been counted, so the final response counts are known.
+	var firstSeen []*openapi.Response
+
+	collectResponse := func(r *openapi.Response, countHeaders bool) (bool, error) {
+		if r == nil || r.Ref.String() != "" {
+			return false, nil
+		}
+
+		bs, err := json.Marshal(r)
+		if err != nil {
+			return false, err
+		}
+
+		if !countHeaders {
+			respCountsByJSON[string(bs)]++
+		}
+		matched := respCountsByJSON[string(bs)] > 1
+		if !countHeaders && respCountsByJSON[string(bs)] == 1 {
+			sharedResp[string(bs)] = r
+			respKeys = append(respKeys, string(bs))
+			firstSeen = append(firstSeen, r)
+		}
+
+		if countHeaders && !matched {
+			// Only consider promoting this response's own headers if the response
+			// itself isn't going to be promoted wholesale.
+			var names []string
+			for name := range r.Headers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				h := r.Headers[name]
+				if h == nil || h.Ref.String() != "" {
+					continue
+				}
+
+				hbs, err := json.Marshal(h)
+				if err != nil {
+					return false, err
+				}
+
+				headerCountsByJSON[string(hbs)]++
+				if headerCountsByJSON[string(hbs)] == 1 {
+					sharedHeaders[string(hbs)] = h
+					headerKeys = append(headerKeys, string(hbs))
+				}
+			}
+		}
+
+		return matched, nil
+	}
+
+	for _, path := range doc.Paths.Paths {
+		for _, op := range operationsOf(path) {
+			if op == nil || op.Responses == nil {
+				continue
+			}
+
+			if _, err := collectResponse(op.Responses.Default, false); err != nil {
+				return nil, nil, nil, nil, err
+			}
+
+			var codes []string
+			for code := range op.Responses.StatusCodeResponses {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for _, code := range codes {
+				if _, err := collectResponse(op.Responses.StatusCodeResponses[code], false); err != nil {
+					return nil, nil, nil, nil, err
+				}
+			}
+		}
+	}
+
+	for _, r := range firstSeen {
+		if _, err := collectResponse(r, true); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	sort.Strings(respKeys)
+	responses = map[string]*openapi.Response{}
+	namesByJSON = map[string]string{}
+	for _, k := range respKeys {
+		if respCountsByJSON[k] <= 1 {
+			// A response that only occurs once would come back out strictly larger
+			// than it went in: a $ref plus a dictionary entry instead of the inline
+			// response. Leave it alone.
+			continue
+		}
+
+		name := componentName("response", k, func(n string) bool { _, ok := responses[n]; return ok })
+		responses[name] = sharedResp[k]
+		namesByJSON[k] = name
+	}
+
+	sort.Strings(headerKeys)
+	headers = map[string]*openapi.Header{}
+	headerNamesByJSON = map[string]string{}
+	for _, k := range headerKeys {
+		if headerCountsByJSON[k] <= 1 {
+			// Same reasoning as the response gate above, for headers considered for
+			// their own promotion.
+			continue
+		}
+
+		name := componentName("header", k, func(n string) bool { _, ok := headers[n]; return ok })
+		headers[name] = sharedHeaders[k]
+		headerNamesByJSON[k] = name
+	}
+
+	return namesByJSON, responses, headerNamesByJSON, headers, nil
+}
+
+// replaceResponse returns a (possibly new) response: a $ref to the shared response when
+// the whole response is shared and, failing that, the response with its shared headers
+// replaced by $refs. It returns the original pointer unchanged when there's nothing to do.
+func replaceResponse(r *openapi.Response, namesByJSON, headerNamesByJSON map[string]string) (*openapi.Response, bool, error) {
+	if r == nil || r.Ref.String() != "" {
+		return r, false, nil
+	}
+
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if name, ok := namesByJSON[string(bs)]; ok {
+		return &openapi.Response{Refable: spec.Refable{Ref: spec.MustCreateRef("#/components/responses/" + name)}}, true, nil
+	}
+
+	var newHeaders map[string]*openapi.Header
+	for name, h := range r.Headers {
+		if h == nil || h.Ref.String() != "" {
+			continue
+		}
+
+		hbs, err := json.Marshal(h)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if headerName, ok := headerNamesByJSON[string(hbs)]; ok {
+			if newHeaders == nil {
+				newHeaders = make(map[string]*openapi.Header, len(r.Headers))
+				for k, v := range r.Headers {
+					newHeaders[k] = v
+				}
+			}
+			newHeaders[name] = &openapi.Header{Refable: spec.Refable{Ref: spec.MustCreateRef("#/components/headers/" + headerName)}}
+		}
+	}
+
+	if newHeaders == nil {
+		return r, false, nil
+	}
+
+	clone := *r
+	clone.Headers = newHeaders
+	return &clone, true, nil
+}
+
+func replaceSharedResponses(namesByJSON, headerNamesByJSON map[string]string, doc *openapi.OpenAPI) (*openapi.OpenAPI, error) {
+	if doc == nil || doc.Paths == nil {
+		return doc, nil
+	}
+
+	ret := doc
+	firstDocChange := true
+
+	for k, path := range doc.Paths.Paths {
+		pathChanged := false
+		clonedPath := path
+		clonePath := func() {
+			if clonedPath != path {
+				return
+			}
+			p := *path
+			clonedPath = &p
+		}
+
+		for _, slot := range pathOperationSlots {
+			op := slot.get(clonedPath)
+			if op == nil || op.Responses == nil {
+				continue
+			}
+
+			origResponses := op.Responses
+			newResponses := *origResponses
+			responsesChanged := false
+
+			if newDefault, changed, err := replaceResponse(origResponses.Default, namesByJSON, headerNamesByJSON); err != nil {
+				return nil, err
+			} else if changed {
+				newResponses.Default = newDefault
+				responsesChanged = true
+			}
+
+			if len(origResponses.StatusCodeResponses) > 0 {
+				var newCodes map[string]*openapi.Response
+				for code, r := range origResponses.StatusCodeResponses {
+					newR, changed, err := replaceResponse(r, namesByJSON, headerNamesByJSON)
+					if err != nil {
+						return nil, err
+					}
+					if !changed {
+						continue
+					}
+					if newCodes == nil {
+						newCodes = make(map[string]*openapi.Response, len(origResponses.StatusCodeResponses))
+						for c, v := range origResponses.StatusCodeResponses {
+							newCodes[c] = v
+						}
+					}
+					newCodes[code] = newR
+				}
+				if newCodes != nil {
+					newResponses.StatusCodeResponses = newCodes
+					responsesChanged = true
+				}
+			}
+
+			if responsesChanged {
+				clonePath()
+				clonedOp := *op
+				clonedOp.Responses = &newResponses
+				slot.set(clonedPath, &clonedOp)
+				pathChanged = true
+			}
+		}
+
+		if pathChanged {
+			if firstDocChange {
+				docClone := *doc
+				ret = &docClone
+
+				pathsClone := *ret.Paths
+				ret.Paths = &pathsClone
+
+				ret.Paths.Paths = make(map[string]*openapi.Path, len(doc.Paths.Paths))
+				for pk, pv := range doc.Paths.Paths {
+					ret.Paths.Paths[pk] = pv
+				}
+
+				firstDocChange = false
+			}
+			ret.Paths.Paths[k] = clonedPath
+		}
+	}
+
+	return ret, nil
+}
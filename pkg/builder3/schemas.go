@@ -0,0 +1,606 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder3
+
+import (
+	"encoding/json"
+	"sort"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	openapi "k8s.io/kube-openapi/pkg/validation/spec3"
+)
+
+// mediaTypeSchemas returns, in deterministic order, the schema of every media type in
+// content that carries one inline.
+func mediaTypeSchemas(content map[string]*openapi.MediaType) []*spec.Schema {
+	var keys []string
+	for k := range content {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var schemas []*spec.Schema
+	for _, k := range keys {
+		if mt := content[k]; mt != nil && mt.Schema != nil {
+			schemas = append(schemas, mt.Schema)
+		}
+	}
+	return schemas
+}
+
+// schemaRootsOf returns every inline schema directly reachable from one operation:
+// its parameters' schemas, its request body's media type schemas, and its responses'
+// (and their headers') media type schemas. Anything already behind a $ref is skipped,
+// since it was either already shared or points at a pre-existing definition.
+func schemaRootsOf(op *openapi.Operation) []*spec.Schema {
+	var roots []*spec.Schema
+
+	for _, p := range op.Parameters {
+		if p == nil || p.Ref.String() != "" {
+			continue
+		}
+		if p.Schema != nil {
+			roots = append(roots, p.Schema)
+		}
+		roots = append(roots, mediaTypeSchemas(p.Content)...)
+	}
+
+	if op.RequestBody != nil && op.RequestBody.Ref.String() == "" {
+		roots = append(roots, mediaTypeSchemas(op.RequestBody.Content)...)
+	}
+
+	if op.Responses != nil {
+		responses := []*openapi.Response{op.Responses.Default}
+		var codes []string
+		for code := range op.Responses.StatusCodeResponses {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			responses = append(responses, op.Responses.StatusCodeResponses[code])
+		}
+
+		for _, r := range responses {
+			if r == nil || r.Ref.String() != "" {
+				continue
+			}
+			roots = append(roots, mediaTypeSchemas(r.Content)...)
+
+			var headerNames []string
+			for name := range r.Headers {
+				headerNames = append(headerNames, name)
+			}
+			sort.Strings(headerNames)
+			for _, name := range headerNames {
+				h := r.Headers[name]
+				if h == nil || h.Ref.String() != "" {
+					continue
+				}
+				if h.Schema != nil {
+					roots = append(roots, h.Schema)
+				}
+				roots = append(roots, mediaTypeSchemas(h.Content)...)
+			}
+		}
+	}
+
+	return roots
+}
+
+// collectSharedSchemas finds inline schema fragments that show up more than once
+// across doc's operations and hence can be shared via doc.Components.Schemas.
+func collectSharedSchemas(doc *openapi.OpenAPI) (namesByJSON map[string]string, ret map[string]*spec.Schema, err error) {
+	if doc == nil || doc.Paths == nil {
+		return nil, nil, nil
+	}
+
+	countsByJSON := map[string]int{}
+	shared := map[string]*spec.Schema{}
+	var keys []string
+
+	collect := func(s *spec.Schema) error {
+		bs, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		countsByJSON[string(bs)]++
+		if count := countsByJSON[string(bs)]; count == 1 {
+			shared[string(bs)] = s
+			keys = append(keys, string(bs))
+		}
+
+		return nil
+	}
+
+	for _, path := range doc.Paths.Paths {
+		for _, op := range operationsOf(path) {
+			if op == nil {
+				continue
+			}
+			for _, s := range schemaRootsOf(op) {
+				if err := collectSchema(s, collect); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	ret = map[string]*spec.Schema{}
+	namesByJSON = map[string]string{}
+	for _, k := range keys {
+		if countsByJSON[k] <= 1 {
+			// A schema that only occurs once would come back out strictly larger than
+			// it went in: a $ref plus a dictionary entry instead of the inline schema.
+			// Leave it alone.
+			continue
+		}
+
+		prefix := shared[k].ID
+		if prefix == "" {
+			prefix = "schema"
+		}
+		name := componentName(prefix, k, func(n string) bool { _, ok := ret[n]; return ok })
+		ret[name] = shared[k]
+		namesByJSON[k] = name
+	}
+
+	return namesByJSON, ret, nil
+}
+
+// collectSchema calls collect on s and, recursively, on every inline (non-$ref) schema
+// reachable from it.
+func collectSchema(s *spec.Schema, collect func(*spec.Schema) error) error {
+	if s == nil || s.Ref.String() != "" {
+		return nil
+	}
+
+	if err := collect(s); err != nil {
+		return err
+	}
+
+	for name := range s.Properties {
+		c := s.Properties[name]
+		if err := collectSchema(&c, collect); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		if err := collectSchema(s.AdditionalProperties.Schema, collect); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if s.Items.Schema != nil {
+			if err := collectSchema(s.Items.Schema, collect); err != nil {
+				return err
+			}
+		}
+		for i := range s.Items.Schemas {
+			if err := collectSchema(&s.Items.Schemas[i], collect); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range s.AllOf {
+		if err := collectSchema(&s.AllOf[i], collect); err != nil {
+			return err
+		}
+	}
+	for i := range s.AnyOf {
+		if err := collectSchema(&s.AnyOf[i], collect); err != nil {
+			return err
+		}
+	}
+	for i := range s.OneOf {
+		if err := collectSchema(&s.OneOf[i], collect); err != nil {
+			return err
+		}
+	}
+	if s.Not != nil {
+		if err := collectSchema(s.Not, collect); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceSchema returns a schema with any inline fragment matching namesByJSON replaced
+// by a $ref to its shared definition, returning the original pointer and changed=false
+// when there's nothing to do below s.
+func replaceSchema(s *spec.Schema, namesByJSON map[string]string) (*spec.Schema, bool, error) {
+	if s == nil || s.Ref.String() != "" {
+		return s, false, nil
+	}
+
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if name, ok := namesByJSON[string(bs)]; ok {
+		return &spec.Schema{SchemaProps: spec.SchemaProps{Ref: spec.MustCreateRef("#/components/schemas/" + name)}}, true, nil
+	}
+
+	changed := false
+	clone := *s
+
+	if len(s.Properties) > 0 {
+		props := make(map[string]spec.Schema, len(s.Properties))
+		for name, child := range s.Properties {
+			c := child
+			newChild, childChanged, err := replaceSchema(&c, namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				changed = true
+				props[name] = *newChild
+			} else {
+				props[name] = child
+			}
+		}
+		clone.Properties = props
+	}
+
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		newChild, childChanged, err := replaceSchema(s.AdditionalProperties.Schema, namesByJSON)
+		if err != nil {
+			return nil, false, err
+		}
+		if childChanged {
+			changed = true
+			apClone := *s.AdditionalProperties
+			apClone.Schema = newChild
+			clone.AdditionalProperties = &apClone
+		}
+	}
+
+	if s.Items != nil {
+		itemsClone := *s.Items
+		itemsChanged := false
+
+		if s.Items.Schema != nil {
+			newChild, childChanged, err := replaceSchema(s.Items.Schema, namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				itemsChanged = true
+				itemsClone.Schema = newChild
+			}
+		}
+
+		if len(s.Items.Schemas) > 0 {
+			schemas := make([]spec.Schema, len(s.Items.Schemas))
+			copy(schemas, s.Items.Schemas)
+			for i := range schemas {
+				newChild, childChanged, err := replaceSchema(&schemas[i], namesByJSON)
+				if err != nil {
+					return nil, false, err
+				}
+				if childChanged {
+					itemsChanged = true
+					schemas[i] = *newChild
+				}
+			}
+			itemsClone.Schemas = schemas
+		}
+
+		if itemsChanged {
+			changed = true
+			clone.Items = &itemsClone
+		}
+	}
+
+	for _, list := range []struct {
+		get func() []spec.Schema
+		set func([]spec.Schema)
+	}{
+		{func() []spec.Schema { return s.AllOf }, func(v []spec.Schema) { clone.AllOf = v }},
+		{func() []spec.Schema { return s.AnyOf }, func(v []spec.Schema) { clone.AnyOf = v }},
+		{func() []spec.Schema { return s.OneOf }, func(v []spec.Schema) { clone.OneOf = v }},
+	} {
+		orig := list.get()
+		if len(orig) == 0 {
+			continue
+		}
+		out := make([]spec.Schema, len(orig))
+		copy(out, orig)
+		listChanged := false
+		for i := range out {
+			newChild, childChanged, err := replaceSchema(&out[i], namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				listChanged = true
+				out[i] = *newChild
+			}
+		}
+		if listChanged {
+			changed = true
+			list.set(out)
+		}
+	}
+
+	if s.Not != nil {
+		newChild, childChanged, err := replaceSchema(s.Not, namesByJSON)
+		if err != nil {
+			return nil, false, err
+		}
+		if childChanged {
+			changed = true
+			clone.Not = newChild
+		}
+	}
+
+	if !changed {
+		return s, false, nil
+	}
+	return &clone, true, nil
+}
+
+func replaceSharedSchemas(namesByJSON map[string]string, doc *openapi.OpenAPI) (*openapi.OpenAPI, error) {
+	if doc == nil || doc.Paths == nil {
+		return doc, nil
+	}
+
+	ret := doc
+	firstDocChange := true
+
+	for k, path := range doc.Paths.Paths {
+		pathChanged := false
+		clonedPath := path
+		clonePath := func() {
+			if clonedPath != path {
+				return
+			}
+			p := *path
+			clonedPath = &p
+		}
+
+		for _, slot := range pathOperationSlots {
+			origOp := slot.get(clonedPath)
+			if origOp == nil {
+				continue
+			}
+
+			clonedOp := *origOp
+			opChanged := false
+
+			var newParams []*openapi.Parameter
+			for i, p := range origOp.Parameters {
+				if p == nil || p.Ref.String() != "" {
+					continue
+				}
+				newSchema, changed, err := replaceSchema(p.Schema, namesByJSON)
+				if err != nil {
+					return nil, err
+				}
+				newContent, contentChanged, err := replaceMediaTypeSchemas(p.Content, namesByJSON)
+				if err != nil {
+					return nil, err
+				}
+				if !changed && !contentChanged {
+					continue
+				}
+				if newParams == nil {
+					newParams = make([]*openapi.Parameter, len(origOp.Parameters))
+					copy(newParams, origOp.Parameters)
+				}
+				clonedParam := *p
+				clonedParam.Schema = newSchema
+				clonedParam.Content = newContent
+				newParams[i] = &clonedParam
+				opChanged = true
+			}
+			if newParams != nil {
+				clonedOp.Parameters = newParams
+			}
+
+			if origOp.RequestBody != nil && origOp.RequestBody.Ref.String() == "" {
+				if newBody, changed, err := replaceRequestBodySchemas(origOp.RequestBody, namesByJSON); err != nil {
+					return nil, err
+				} else if changed {
+					clonedOp.RequestBody = newBody
+					opChanged = true
+				}
+			}
+
+			if origOp.Responses != nil {
+				if newResponses, changed, err := replaceResponsesSchemas(origOp.Responses, namesByJSON); err != nil {
+					return nil, err
+				} else if changed {
+					clonedOp.Responses = newResponses
+					opChanged = true
+				}
+			}
+
+			if opChanged {
+				clonePath()
+				slot.set(clonedPath, &clonedOp)
+				pathChanged = true
+			}
+		}
+
+		if pathChanged {
+			if firstDocChange {
+				docClone := *doc
+				ret = &docClone
+
+				pathsClone := *ret.Paths
+				ret.Paths = &pathsClone
+
+				ret.Paths.Paths = make(map[string]*openapi.Path, len(doc.Paths.Paths))
+				for pk, pv := range doc.Paths.Paths {
+					ret.Paths.Paths[pk] = pv
+				}
+
+				firstDocChange = false
+			}
+			ret.Paths.Paths[k] = clonedPath
+		}
+	}
+
+	return ret, nil
+}
+
+func replaceMediaTypeSchemas(content map[string]*openapi.MediaType, namesByJSON map[string]string) (map[string]*openapi.MediaType, bool, error) {
+	var out map[string]*openapi.MediaType
+	for k, mt := range content {
+		if mt == nil || mt.Schema == nil {
+			continue
+		}
+		newSchema, changed, err := replaceSchema(mt.Schema, namesByJSON)
+		if err != nil {
+			return nil, false, err
+		}
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]*openapi.MediaType, len(content))
+			for k, v := range content {
+				out[k] = v
+			}
+		}
+		clonedMT := *mt
+		clonedMT.Schema = newSchema
+		out[k] = &clonedMT
+	}
+	if out == nil {
+		return content, false, nil
+	}
+	return out, true, nil
+}
+
+func replaceRequestBodySchemas(body *openapi.RequestBody, namesByJSON map[string]string) (*openapi.RequestBody, bool, error) {
+	newContent, changed, err := replaceMediaTypeSchemas(body.Content, namesByJSON)
+	if err != nil || !changed {
+		return body, changed, err
+	}
+	clone := *body
+	clone.Content = newContent
+	return &clone, true, nil
+}
+
+func replaceResponsesSchemas(responses *openapi.Responses, namesByJSON map[string]string) (*openapi.Responses, bool, error) {
+	clone := *responses
+	changed := false
+
+	if newDefault, c, err := replaceResponseSchemas(responses.Default, namesByJSON); err != nil {
+		return nil, false, err
+	} else if c {
+		clone.Default = newDefault
+		changed = true
+	}
+
+	if len(responses.StatusCodeResponses) > 0 {
+		var newCodes map[string]*openapi.Response
+		for code, r := range responses.StatusCodeResponses {
+			newR, c, err := replaceResponseSchemas(r, namesByJSON)
+			if err != nil {
+				return nil, false, err
+			}
+			if !c {
+				continue
+			}
+			if newCodes == nil {
+				newCodes = make(map[string]*openapi.Response, len(responses.StatusCodeResponses))
+				for cc, v := range responses.StatusCodeResponses {
+					newCodes[cc] = v
+				}
+			}
+			newCodes[code] = newR
+		}
+		if newCodes != nil {
+			clone.StatusCodeResponses = newCodes
+			changed = true
+		}
+	}
+
+	if !changed {
+		return responses, false, nil
+	}
+	return &clone, true, nil
+}
+
+func replaceResponseSchemas(r *openapi.Response, namesByJSON map[string]string) (*openapi.Response, bool, error) {
+	if r == nil || r.Ref.String() != "" {
+		return r, false, nil
+	}
+
+	changed := false
+	clone := *r
+
+	if newContent, c, err := replaceMediaTypeSchemas(r.Content, namesByJSON); err != nil {
+		return nil, false, err
+	} else if c {
+		clone.Content = newContent
+		changed = true
+	}
+
+	if len(r.Headers) > 0 {
+		var newHeaders map[string]*openapi.Header
+		for name, h := range r.Headers {
+			if h == nil || h.Ref.String() != "" {
+				continue
+			}
+
+			headerChanged := false
+			clonedHeader := *h
+
+			if h.Schema != nil {
+				if newSchema, c, err := replaceSchema(h.Schema, namesByJSON); err != nil {
+					return nil, false, err
+				} else if c {
+					clonedHeader.Schema = newSchema
+					headerChanged = true
+				}
+			}
+			if newContent, c, err := replaceMediaTypeSchemas(h.Content, namesByJSON); err != nil {
+				return nil, false, err
+			} else if c {
+				clonedHeader.Content = newContent
+				headerChanged = true
+			}
+
+			if !headerChanged {
+				continue
+			}
+			if newHeaders == nil {
+				newHeaders = make(map[string]*openapi.Header, len(r.Headers))
+				for k, v := range r.Headers {
+					newHeaders[k] = v
+				}
+			}
+			newHeaders[name] = &clonedHeader
+		}
+		if newHeaders != nil {
+			clone.Headers = newHeaders
+			changed = true
+		}
+	}
+
+	if !changed {
+		return r, false, nil
+	}
+	return &clone, true, nil
+}